@@ -15,6 +15,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ncw/swift/v2"
@@ -38,6 +39,7 @@ func init() {
 		Name:        "internetarchive",
 		Description: "Internet Archive",
 		NewFs:       NewFs,
+		CommandHelp: commandHelp,
 
 		MetadataInfo: &fs.MetadataInfo{
 			System: map[string]fs.MetadataHelp{
@@ -165,6 +167,39 @@ Only enable if you need to be guaranteed to be reflected after write operations.
 0 to disable waiting. No errors to be thrown in case of timeout.`,
 			Default:  fs.Duration(0),
 			Advanced: true,
+		}, {
+			Name: "show_history",
+			Help: `Show the history/ directory of the item in listings.
+
+Internet Archive keeps the old versions of replaced or deleted files
+in the history/ directory of the item. These are hidden by default so
+that normal syncs don't pick them up, but audit mirrors may want them.`,
+			Default:  false,
+			Advanced: true,
+		}, {
+			Name: "show_reviews",
+			Help: `Show the reviews file (<identifier>_reviews.xml) of the item in listings.
+
+This file is maintained by Internet Archive from the reviews left on
+the item. It is hidden by default.`,
+			Default:  false,
+			Advanced: true,
+		}, {
+			Name: "sidecar_metadata",
+			Help: `Read file metadata from sidecar files when uploading.
+
+If set, when uploading "file" rclone looks for "file.meta.json" next
+to it in the source. This should contain a JSON object whose keys are
+metadata names and values are either a string or a list of strings,
+e.g. {"title": "My Title", "subject": ["a", "b"]}. These are set as
+the metadata of the uploaded file following the same rules as
+--metadata-set, and take precedence over it for keys set by both.
+Invalid keys and values are skipped with a warning.
+
+The sidecar files are uploaded as normal files too, so exclude them
+with --exclude "*.meta.json" if that isn't wanted.`,
+			Default:  false,
+			Advanced: true,
 		}, {
 			Name:     config.ConfigEncoding,
 			Help:     config.ConfigEncodingHelp,
@@ -181,9 +216,39 @@ Only enable if you need to be guaranteed to be reflected after write operations.
 		}})
 }
 
+var commandHelp = []fs.CommandHelp{{
+	Name:  "zip",
+	Short: "Return the URL of a zip archive of the whole item",
+	Long: `This returns the URL of the on-the-fly zip endpoint of Internet
+Archive, which serves all the files of the item as a single archive.
+Downloading that is much quicker than fetching items with lots of
+small files one by one.
+
+The remote must point to the item itself, not a directory inside it.
+It is an error if the item doesn't exist.
+
+Usage Example:
+
+    rclone backend zip ia:item
+
+To download the archive, pass the URL to copyurl, e.g.
+
+    rclone copyurl "$(rclone backend zip ia:item)" dst:item.zip
+
+Note that copyurl doesn't use the credentials of this remote, so this
+only works for items which can be downloaded anonymously.
+`,
+}}
+
 // maximum size of an item. this is constant across all items
 const iaItemMaxSize int64 = 1099511627776
 
+// suffix of the sidecar files read by sidecar_metadata
+const sidecarSuffix = ".meta.json"
+
+// maximum size of a sidecar file we are prepared to read
+const sidecarMaxSize = 1024 * 1024
+
 // metadata keys that are not writeable
 var roMetadataKey = map[string]interface{}{
 	// do not add mtime here, it's a documented exception
@@ -200,6 +265,9 @@ type Options struct {
 	FrontEndpoint   string               `config:"front_endpoint"`
 	DisableChecksum bool                 `config:"disable_checksum"`
 	WaitArchive     fs.Duration          `config:"wait_archive"`
+	ShowHistory     bool                 `config:"show_history"`
+	ShowReviews     bool                 `config:"show_reviews"`
+	SidecarMetadata bool                 `config:"sidecar_metadata"`
 	Enc             encoder.MultiEncoder `config:"encoding"`
 }
 
@@ -225,6 +293,9 @@ type Object struct {
 	sha1    string    // sha1 hash of the file presented by the server
 	crc32   string    // crc32 of the file presented by the server
 	rawData json.RawMessage
+
+	downloadMu  sync.Mutex // protects downloadURL
+	downloadURL string     // datanode URL the download was redirected to
 }
 
 // IAFile represents a subset of object in MetadataResponse.Files
@@ -481,7 +552,7 @@ func (f *Fs) List(ctx context.Context, dir string) (entries fs.DirEntries, err e
 	}
 	grandparent := f.opt.Enc.ToStandardPath(strings.Trim(path.Join(bucket, reqDir), "/") + "/")
 
-	allEntries, err := f.listAllUnconstrained(ctx, bucket)
+	allEntries, err := f.listAll(ctx, bucket)
 	if err != nil {
 		return entries, err
 	}
@@ -531,6 +602,7 @@ func (f *Fs) NewObject(ctx context.Context, remote string) (ret fs.Object, err e
 
 	grandparent := f.opt.Enc.ToStandardPath(strings.Trim(path.Join(bucket, filepath), "/"))
 
+	// hidden files can still be found if they are asked for by name
 	allEntries, err := f.listAllUnconstrained(ctx, bucket)
 	if err != nil {
 		return nil, err
@@ -636,6 +708,39 @@ func (f *Fs) Copy(ctx context.Context, src fs.Object, remote string) (_ fs.Objec
 	return f.waitFileUpload(ctx, trimPathPrefix(path.Join(dstBucket, dstPath), f.root, f.opt.Enc), updateTracker, srcObj.size)
 }
 
+// Command the backend to run a named command
+//
+// The command run is name
+// args may be used to read arguments from
+// opts may be used to read optional arguments from
+//
+// The result should be capable of being JSON encoded
+// If it is a string or a []string it will be shown to the user
+// otherwise it will be JSON encoded and shown to the user like that
+func (f *Fs) Command(ctx context.Context, name string, arg []string, opt map[string]string) (out interface{}, err error) {
+	switch name {
+	case "zip":
+		bucket, bucketPath := f.split("")
+		if bucket == "" {
+			return nil, fs.ErrorListBucketRequired
+		}
+		if bucketPath != "" {
+			return nil, errors.New("zip can only be used on the whole item, not a directory inside it")
+		}
+		// check the item exists, as the metadata of missing items is empty
+		result, err := f.requestMetadata(ctx, bucket)
+		if err != nil {
+			return nil, err
+		}
+		if len(result.Files) == 0 {
+			return nil, fs.ErrorDirNotFound
+		}
+		return strings.TrimRight(f.opt.FrontEndpoint, "/") + zipPath(bucket), nil
+	default:
+		return nil, fs.ErrorCommandNotFound
+	}
+}
+
 // ListR lists the objects and directories of the Fs starting
 // from dir recursively into out.
 //
@@ -663,7 +768,7 @@ func (f *Fs) ListR(ctx context.Context, dir string, callback fs.ListRCallback) (
 	}
 	grandparent := f.opt.Enc.ToStandardPath(strings.Trim(path.Join(bucket, reqDir), "/") + "/")
 
-	allEntries, err = f.listAllUnconstrained(ctx, bucket)
+	allEntries, err = f.listAll(ctx, bucket)
 	if err != nil {
 		return err
 	}
@@ -763,6 +868,30 @@ func (o *Object) Open(ctx context.Context, options ...fs.OpenOption) (in io.Read
 		Path:    path.Join("/download/", o.fs.root, quotePath(o.fs.opt.Enc.FromStandardPath(o.remote))),
 		Options: optionsFixed,
 	}
+	// the frontend redirects to a datanode holding the file, so go there
+	// directly if we've already resolved it (e.g. for multi-thread copy)
+	downloadURL := o.getDownloadURL()
+	if downloadURL != "" {
+		frontOpts := opts
+		opts.Path = ""
+		opts.RootURL = downloadURL
+		// only try once as resolving again is cheaper than retrying a
+		// datanode which has gone away
+		err = o.fs.pacer.CallNoRetry(func() (bool, error) {
+			resp, err = o.fs.front.Call(ctx, &opts)
+			return o.fs.shouldRetry(resp, err)
+		})
+		if err == nil {
+			return resp.Body, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		// the file might have moved to another datanode
+		fs.Debugf(o, "Failed to download from %q, resolving again: %v", downloadURL, err)
+		o.setDownloadURL("")
+		opts = frontOpts
+	}
 	err = o.fs.pacer.Call(func() (bool, error) {
 		resp, err = o.fs.front.Call(ctx, &opts)
 		return o.fs.shouldRetry(resp, err)
@@ -770,9 +899,42 @@ func (o *Object) Open(ctx context.Context, options ...fs.OpenOption) (in io.Read
 	if err != nil {
 		return nil, err
 	}
+	// f.front sends the Authorization header on every request, so only
+	// reuse URLs on the frontend or its subdomains (the datanodes), which
+	// is where the redirect would have forwarded it to anyway
+	if resp.Request != nil && resp.Request.URL != nil && o.fs.isFrontHost(resp.Request.URL.Hostname()) {
+		o.setDownloadURL(resp.Request.URL.String())
+	}
 	return resp.Body, nil
 }
 
+// isFrontHost returns true if host is the host of the frontend or one
+// of its subdomains
+func (f *Fs) isFrontHost(host string) bool {
+	fe, err := url.Parse(f.opt.FrontEndpoint)
+	if err != nil {
+		return false
+	}
+	frontHost := strings.ToLower(fe.Hostname())
+	host = strings.ToLower(host)
+	return frontHost != "" && (host == frontHost || strings.HasSuffix(host, "."+frontHost))
+}
+
+// getDownloadURL returns the resolved download URL of the object or
+// "" if it isn't known yet
+func (o *Object) getDownloadURL() string {
+	o.downloadMu.Lock()
+	defer o.downloadMu.Unlock()
+	return o.downloadURL
+}
+
+// setDownloadURL sets the resolved download URL of the object
+func (o *Object) setDownloadURL(downloadURL string) {
+	o.downloadMu.Lock()
+	o.downloadURL = downloadURL
+	o.downloadMu.Unlock()
+}
+
 // Update the Object from in with modTime and size
 func (o *Object) Update(ctx context.Context, in io.Reader, src fs.ObjectInfo, options ...fs.OpenOption) (err error) {
 	bucket, bucketPath := o.split()
@@ -799,22 +961,9 @@ func (o *Object) Update(ctx context.Context, in io.Reader, src fs.ObjectInfo, op
 		headers["Content-Length"] = fmt.Sprintf("%d", size)
 		headers["x-archive-size-hint"] = fmt.Sprintf("%d", size)
 	}
-	var mdata fs.Metadata
-	mdata, err = fs.GetMetadataOptions(ctx, src, options)
-	if err == nil && mdata != nil {
-		for mk, mv := range mdata {
-			mk = strings.ToLower(mk)
-			if strings.HasPrefix(mk, "rclone-") {
-				fs.LogPrintf(fs.LogLevelWarning, o, "reserved metadata key %s is about to set", mk)
-			} else if _, ok := roMetadataKey[mk]; ok {
-				fs.LogPrintf(fs.LogLevelWarning, o, "setting or modifying read-only key %s is requested, skipping", mk)
-				continue
-			} else if mk == "mtime" {
-				// redirect to make it work
-				mk = "rclone-mtime"
-			}
-			headers[fmt.Sprintf("x-amz-filemeta-%s", mk)] = mv
-		}
+	err = o.addMetadataHeaders(ctx, src, options, headers)
+	if err != nil {
+		return err
 	}
 
 	// read the md5sum if available
@@ -858,9 +1007,113 @@ func (o *Object) Update(ctx context.Context, in io.Reader, src fs.ObjectInfo, op
 	o.sha1 = newObj.sha1
 	o.modTime = newObj.modTime
 	o.size = newObj.size
+	o.setDownloadURL("")
 	return err
 }
 
+// addMetadataHeaders adds the metadata of src from --metadata and
+// --metadata-set to headers, along with the contents of its sidecar
+// file if enabled. Values from the sidecar file take precedence.
+func (o *Object) addMetadataHeaders(ctx context.Context, src fs.ObjectInfo, options []fs.OpenOption, headers map[string]string) error {
+	meta := make(map[string][]string)
+	mdata, err := fs.GetMetadataOptions(ctx, src, options)
+	if err == nil {
+		for mk, mv := range mdata {
+			if mk, ok := checkMetadataKey(o, mk); ok {
+				meta[mk] = []string{mv}
+			}
+		}
+	}
+	if o.fs.opt.SidecarMetadata {
+		sidecarMeta, err := o.fs.readSidecarMetadata(ctx, src)
+		if err != nil {
+			return err
+		}
+		for mk, values := range sidecarMeta {
+			meta[mk] = values
+		}
+	}
+
+	for mk, values := range meta {
+		// IAS3 uses -- in place of _ in metadata headers
+		mk = strings.ReplaceAll(mk, "_", "--")
+		if len(values) == 1 {
+			headers["x-amz-filemeta-"+mk] = quoteMetaValue(values[0])
+			continue
+		}
+		// a list replaces any single value set already, e.g. rclone-mtime
+		delete(headers, "x-amz-filemeta-"+mk)
+		for i, value := range values {
+			headers[fmt.Sprintf("x-amz-filemeta%02d-%s", i+1, mk)] = quoteMetaValue(value)
+		}
+	}
+	return nil
+}
+
+// checkMetadataKey normalises the metadata key mk, returning false if
+// it can't be set
+func checkMetadataKey(what interface{}, mk string) (string, bool) {
+	mk = strings.ToLower(mk)
+	if !matchMetadataKey.MatchString(mk) {
+		fs.LogPrintf(fs.LogLevelWarning, what, "invalid metadata key %q is requested, skipping", mk)
+		return "", false
+	}
+	if strings.HasPrefix(mk, "rclone-") {
+		fs.LogPrintf(fs.LogLevelWarning, what, "reserved metadata key %s is about to set", mk)
+	} else if _, ok := roMetadataKey[mk]; ok {
+		fs.LogPrintf(fs.LogLevelWarning, what, "setting or modifying read-only key %s is requested, skipping", mk)
+		return "", false
+	} else if mk == "mtime" {
+		// redirect to make it work
+		mk = "rclone-mtime"
+	}
+	return mk, true
+}
+
+// readSidecarMetadata reads the sidecar metadata file of src, if any,
+// returning the values for each checked key
+func (f *Fs) readSidecarMetadata(ctx context.Context, src fs.ObjectInfo) (meta map[string][]string, err error) {
+	if strings.HasSuffix(src.Remote(), sidecarSuffix) {
+		return nil, nil
+	}
+	srcFs, ok := src.Fs().(fs.Fs)
+	if !ok {
+		return nil, nil
+	}
+	sidecar, err := srcFs.NewObject(ctx, src.Remote()+sidecarSuffix)
+	if errors.Is(err, fs.ErrorObjectNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to find sidecar metadata: %w", err)
+	}
+	if sidecar.Size() > sidecarMaxSize {
+		return nil, fmt.Errorf("sidecar metadata %q is too big: %d > %d bytes", sidecar.Remote(), sidecar.Size(), sidecarMaxSize)
+	}
+	in, err := sidecar.Open(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sidecar metadata: %w", err)
+	}
+	defer fs.CheckClose(in, &err)
+
+	raw := make(map[string]json.RawMessage)
+	err = json.NewDecoder(io.LimitReader(in, sidecarMaxSize)).Decode(&raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse sidecar metadata %q: %w", sidecar.Remote(), err)
+	}
+	meta = make(map[string][]string, len(raw))
+	for k, v := range raw {
+		values, parseErr := listOrString(v)
+		if parseErr != nil {
+			fs.LogPrintf(fs.LogLevelWarning, src, "value of metadata key %q in %q is not a string or a list of strings, skipping", k, sidecar.Remote())
+			continue
+		}
+		if mk, ok := checkMetadataKey(src, k); ok {
+			meta[mk] = values
+		}
+	}
+	return meta, nil
+}
+
 // Remove an object
 func (o *Object) Remove(ctx context.Context) (err error) {
 	bucket, bucketPath := o.split()
@@ -935,6 +1188,8 @@ func (f *Fs) shouldRetry(resp *http.Response, err error) (bool, error) {
 
 var matchMd5 = regexp.MustCompile(`^[0-9a-f]{32}$`)
 
+var matchMetadataKey = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+
 // split returns bucket and bucketPath from the rootRelativePath
 // relative to f.root
 func (f *Fs) split(rootRelativePath string) (bucketName, bucketPath string) {
@@ -966,6 +1221,11 @@ func (f *Fs) requestMetadata(ctx context.Context, bucket string) (result *Metada
 	return temp.unraw()
 }
 
+// zipPath returns the path of the zip archive of bucket on the frontend
+func zipPath(bucket string) string {
+	return "/compress/" + url.PathEscape(bucket)
+}
+
 // list up all files/directories without any filters
 func (f *Fs) listAllUnconstrained(ctx context.Context, bucket string) (entries fs.DirEntries, err error) {
 	result, err := f.requestMetadata(ctx, bucket)
@@ -1008,6 +1268,40 @@ func (f *Fs) listAllUnconstrained(ctx context.Context, bucket string) (entries f
 	return entries, nil
 }
 
+// list up all files/directories except the ones hidden by the options
+func (f *Fs) listAll(ctx context.Context, bucket string) (entries fs.DirEntries, err error) {
+	allEntries, err := f.listAllUnconstrained(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+	prefix := f.opt.Enc.ToStandardName(bucket) + "/"
+	for _, ent := range allEntries {
+		if !f.isHidden(bucket, strings.TrimPrefix(ent.Remote(), prefix)) {
+			entries = append(entries, ent)
+		}
+	}
+	return entries, nil
+}
+
+// isHidden returns true if the bucketPath (in standard encoding) of
+// the bucket should be left out of listings
+func (f *Fs) isHidden(bucketName, bucketPath string) bool {
+	// the user asked for history/ explicitly if the root is inside it
+	_, rootPath := bucket.Split(f.root)
+	if !f.opt.ShowHistory && isHistoryPath(bucketPath) && !isHistoryPath(rootPath) {
+		return true
+	}
+	if !f.opt.ShowReviews && bucketPath == f.opt.Enc.ToStandardName(bucketName+"_reviews.xml") {
+		return true
+	}
+	return false
+}
+
+// isHistoryPath returns true if bucketPath is in the history/ directory
+func isHistoryPath(bucketPath string) bool {
+	return bucketPath == "history" || strings.HasPrefix(bucketPath, "history/")
+}
+
 func (f *Fs) waitFileUpload(ctx context.Context, reqPath, tracker string, newSize int64) (ret *Object, err error) {
 	bucket, bucketPath := f.split(reqPath)
 
@@ -1273,6 +1567,17 @@ func trimPathPrefix(s, prefix string, enc encoder.MultiEncoder) string {
 	return enc.ToStandardPath(strings.TrimPrefix(s, prefix+"/"))
 }
 
+// quoteMetaValue makes value safe for x-archive-meta-* headers,
+// wrapping non-ASCII values in uri() as IAS3 expects
+func quoteMetaValue(value string) string {
+	for _, c := range value {
+		if c < 0x20 || c > 0x7e {
+			return "uri(" + url.PathEscape(value) + ")"
+		}
+	}
+	return value
+}
+
 // mimics urllib.parse.quote() on Python; exclude / from url.PathEscape
 func quotePath(s string) string {
 	seg := strings.Split(s, "/")
@@ -1290,6 +1595,7 @@ var (
 	_ fs.CleanUpper   = &Fs{}
 	_ fs.PublicLinker = &Fs{}
 	_ fs.Abouter      = &Fs{}
+	_ fs.Commander    = &Fs{}
 	_ fs.Object       = &Object{}
 	_ fs.Metadataer   = &Object{}
 )
@@ -0,0 +1,419 @@
+package internetarchive
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/rclone/rclone/backend/memory"
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/object"
+	"github.com/rclone/rclone/lib/pacer"
+	"github.com/rclone/rclone/lib/rest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestFs makes an Fs rooted at the item "item" which talks to the
+// frontend at frontURL
+func newTestFs(frontURL string) *Fs {
+	ctx := context.Background()
+	f := &Fs{
+		name: "TestIA",
+		root: "item",
+		opt:  Options{FrontEndpoint: frontURL},
+		ctx:  ctx,
+	}
+	f.front = rest.NewClient(http.DefaultClient).SetRoot(frontURL)
+	f.pacer = fs.NewPacer(ctx, pacer.NewS3(pacer.MinSleep(time.Millisecond)))
+	return f
+}
+
+func TestIsHidden(t *testing.T) {
+	for _, test := range []struct {
+		root        string
+		showHistory bool
+		showReviews bool
+		bucketPath  string
+		want        bool
+	}{
+		{"item", false, false, "file.txt", false},
+		{"item", false, false, "history", true},
+		{"item", false, false, "history/x", true},
+		{"item", false, false, "dir/history/x", false},
+		{"item", false, false, "historyx", false},
+		{"item", false, false, "item_reviews.xml", true},
+		{"item", false, false, "other_reviews.xml", false},
+		{"item", true, false, "history", false},
+		{"item", true, false, "history/x", false},
+		{"item", true, false, "item_reviews.xml", true},
+		{"item", false, true, "history/x", true},
+		{"item", false, true, "item_reviews.xml", false},
+		{"item", true, true, "history/x", false},
+		{"item", true, true, "item_reviews.xml", false},
+		{"item/history", false, false, "history/x", false},
+		{"item/history/files", false, false, "history/files/x", false},
+		{"item/dir", false, false, "history/x", true},
+	} {
+		f := &Fs{
+			root: test.root,
+			opt: Options{
+				ShowHistory: test.showHistory,
+				ShowReviews: test.showReviews,
+			},
+		}
+		got := f.isHidden("item", test.bucketPath)
+		assert.Equal(t, test.want, got, "root=%q showHistory=%v showReviews=%v path=%q", test.root, test.showHistory, test.showReviews, test.bucketPath)
+	}
+}
+
+func TestOpenDatanodeRedirect(t *testing.T) {
+	ctx := context.Background()
+	content := []byte("0123456789")
+
+	var (
+		mu           sync.Mutex
+		location     = "/old"
+		frontHits    int
+		datanodeHits int
+	)
+	hits := func() (int, int) {
+		mu.Lock()
+		defer mu.Unlock()
+		return frontHits, datanodeHits
+	}
+
+	datanode := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		datanodeHits++
+		current := location
+		mu.Unlock()
+		if r.URL.Path != current+"/items/item/file.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "file.txt", time.Time{}, bytes.NewReader(content))
+	}))
+	defer datanode.Close()
+
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		frontHits++
+		current := location
+		mu.Unlock()
+		if r.URL.Path != "/download/item/file.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		http.Redirect(w, r, datanode.URL+current+"/items/item/file.txt", http.StatusFound)
+	}))
+	defer front.Close()
+
+	o := &Object{
+		fs:     newTestFs(front.URL),
+		remote: "file.txt",
+		size:   int64(len(content)),
+	}
+	read := func(start, end int64) string {
+		in, err := o.Open(ctx, &fs.RangeOption{Start: start, End: end})
+		require.NoError(t, err)
+		data, err := io.ReadAll(in)
+		require.NoError(t, err)
+		require.NoError(t, in.Close())
+		return string(data)
+	}
+
+	// the first Open resolves the datanode through the frontend
+	assert.Equal(t, "234", read(2, 4))
+	front1, datanode1 := hits()
+	assert.Equal(t, 1, front1)
+	assert.Equal(t, 1, datanode1)
+
+	// the second Open goes straight to the datanode
+	assert.Equal(t, "567", read(5, 7))
+	front2, datanode2 := hits()
+	assert.Equal(t, 1, front2)
+	assert.Equal(t, 2, datanode2)
+
+	// the file moves, so the old URL gives 404 and Open resolves again
+	mu.Lock()
+	location = "/new"
+	mu.Unlock()
+	assert.Equal(t, "89", read(8, 9))
+	front3, datanode3 := hits()
+	assert.Equal(t, 2, front3)
+	assert.Equal(t, 4, datanode3)
+
+	// and the new URL is used from then on
+	assert.Equal(t, "01", read(0, 1))
+	front4, datanode4 := hits()
+	assert.Equal(t, 2, front4)
+	assert.Equal(t, 5, datanode4)
+}
+
+// newSidecarTestFs makes a memory Fs and a function to put files into it
+func newSidecarTestFs(ctx context.Context, t *testing.T) func(remote, content string) fs.Object {
+	srcFs, err := fs.NewFs(ctx, ":memory:")
+	require.NoError(t, err)
+	return func(remote, content string) fs.Object {
+		src := object.NewStaticObjectInfo(remote, time.Now(), int64(len(content)), true, nil, nil)
+		o, err := srcFs.Put(ctx, strings.NewReader(content), src)
+		require.NoError(t, err)
+		return o
+	}
+}
+
+func TestIsFrontHost(t *testing.T) {
+	f := &Fs{opt: Options{FrontEndpoint: "https://archive.org"}}
+	for _, test := range []struct {
+		host string
+		want bool
+	}{
+		{"archive.org", true},
+		{"ARCHIVE.org", true},
+		{"ia800000.us.archive.org", true},
+		{"notarchive.org", false},
+		{"archive.org.example.com", false},
+		{"cdn.example.com", false},
+		{"", false},
+	} {
+		assert.Equal(t, test.want, f.isFrontHost(test.host), test.host)
+	}
+}
+
+func TestOpenOffsiteRedirect(t *testing.T) {
+	ctx := context.Background()
+	content := []byte("0123456789")
+
+	var (
+		mu        sync.Mutex
+		frontHits int
+	)
+	// use "localhost" for the mirror so it isn't the host of the frontend
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.txt", time.Time{}, bytes.NewReader(content))
+	}))
+	defer mirror.Close()
+	mirrorURL := strings.Replace(mirror.URL, "127.0.0.1", "localhost", 1)
+
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		frontHits++
+		mu.Unlock()
+		http.Redirect(w, r, mirrorURL+"/file.txt", http.StatusFound)
+	}))
+	defer front.Close()
+
+	o := &Object{
+		fs:     newTestFs(front.URL),
+		remote: "file.txt",
+		size:   int64(len(content)),
+	}
+	for i := 1; i <= 2; i++ {
+		in, err := o.Open(ctx, &fs.RangeOption{Start: 0, End: 1})
+		require.NoError(t, err)
+		data, err := io.ReadAll(in)
+		require.NoError(t, err)
+		require.NoError(t, in.Close())
+		assert.Equal(t, "01", string(data))
+		assert.Equal(t, "", o.getDownloadURL())
+		mu.Lock()
+		assert.Equal(t, i, frontHits)
+		mu.Unlock()
+	}
+}
+
+func TestReadSidecarMetadata(t *testing.T) {
+	ctx := context.Background()
+	put := newSidecarTestFs(ctx, t)
+
+	f := &Fs{}
+	for _, test := range []struct {
+		name    string
+		sidecar string // no sidecar if empty
+		want    map[string][]string
+		wantErr string
+	}{{
+		name: "missing",
+		want: nil,
+	}, {
+		name:    "string",
+		sidecar: `{"Title": "My Title"}`,
+		want:    map[string][]string{"title": {"My Title"}},
+	}, {
+		name:    "list",
+		sidecar: `{"subject": ["a", "b"]}`,
+		want:    map[string][]string{"subject": {"a", "b"}},
+	}, {
+		name:    "reserved",
+		sidecar: `{"md5": "x", "mtime": "y", "rclone-update-track": "z"}`,
+		want:    map[string][]string{"rclone-mtime": {"y"}, "rclone-update-track": {"z"}},
+	}, {
+		name:    "notstring",
+		sidecar: `{"count": 3, "title": "x"}`,
+		want:    map[string][]string{"title": {"x"}},
+	}, {
+		name:    "invalidkey",
+		sidecar: `{"my key": "x", "title": "y"}`,
+		want:    map[string][]string{"title": {"y"}},
+	}, {
+		name:    "badjson",
+		sidecar: `["title"]`,
+		wantErr: "failed to parse sidecar metadata",
+	}, {
+		name:    "toobig",
+		sidecar: `{"title": "` + strings.Repeat("x", sidecarMaxSize) + `"}`,
+		wantErr: "too big",
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			remote := "sidecar/" + test.name + ".txt"
+			src := put(remote, "content")
+			if test.sidecar != "" {
+				put(remote+sidecarSuffix, test.sidecar)
+			}
+			got, err := f.readSidecarMetadata(ctx, src)
+			if test.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.want, got)
+		})
+	}
+
+	// the sidecar files themselves don't have sidecars
+	sidecar := put("sidecar/self.txt"+sidecarSuffix, `{"title": "x"}`)
+	put("sidecar/self.txt"+sidecarSuffix+sidecarSuffix, `{"title": "y"}`)
+	got, err := f.readSidecarMetadata(ctx, sidecar)
+	require.NoError(t, err)
+	assert.Nil(t, got)
+}
+
+func TestAddMetadataHeaders(t *testing.T) {
+	ctx, ci := fs.AddConfig(context.Background())
+	ci.Metadata = true
+	put := newSidecarTestFs(ctx, t)
+
+	src := put("metadata/file.txt", "content")
+	put("metadata/file.txt"+sidecarSuffix, `{
+		"title": "B",
+		"subject": ["a", "b"],
+		"external_id": "x",
+		"rclone-mtime": ["2001-01-01T00:00:00Z", "2002-02-02T00:00:00Z"]
+	}`)
+	options := []fs.OpenOption{fs.MetadataOption{
+		"title":       "A",
+		"description": "café",
+		"mtime":       "2000-01-01T00:00:00Z",
+		"md5":         "0123",
+		"bad key":     "x",
+	}}
+
+	for _, test := range []struct {
+		name    string
+		sidecar bool
+		want    map[string]string
+	}{{
+		name:    "metadata-set",
+		sidecar: false,
+		want: map[string]string{
+			"x-amz-filemeta-title":        "A",
+			"x-amz-filemeta-description":  "uri(caf%C3%A9)",
+			"x-amz-filemeta-rclone-mtime": "2000-01-01T00:00:00Z",
+		},
+	}, {
+		name:    "sidecar-overrides",
+		sidecar: true,
+		want: map[string]string{
+			"x-amz-filemeta-title":          "B",
+			"x-amz-filemeta-description":    "uri(caf%C3%A9)",
+			"x-amz-filemeta01-subject":      "a",
+			"x-amz-filemeta02-subject":      "b",
+			"x-amz-filemeta-external--id":   "x",
+			"x-amz-filemeta01-rclone-mtime": "2001-01-01T00:00:00Z",
+			"x-amz-filemeta02-rclone-mtime": "2002-02-02T00:00:00Z",
+		},
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			o := &Object{
+				fs:     &Fs{opt: Options{SidecarMetadata: test.sidecar}},
+				remote: "file.txt",
+			}
+			// as set by Update before the metadata is added
+			headers := map[string]string{
+				"x-amz-filemeta-rclone-mtime": "1999-01-01T00:00:00Z",
+			}
+			require.NoError(t, o.addMetadataHeaders(ctx, src, options, headers))
+			assert.Equal(t, test.want, headers)
+		})
+	}
+}
+
+func TestQuoteMetaValue(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want string
+	}{
+		{"", ""},
+		{"plain value", "plain value"},
+		{"café", "uri(caf%C3%A9)"},
+		{"line\nbreak", "uri(line%0Abreak)"},
+	} {
+		assert.Equal(t, test.want, quoteMetaValue(test.in), test.in)
+	}
+}
+
+func TestZipPath(t *testing.T) {
+	assert.Equal(t, "/compress/item", zipPath("item"))
+	assert.Equal(t, "/compress/my%20item%3F", zipPath("my item?"))
+}
+
+func TestCommandZip(t *testing.T) {
+	ctx := context.Background()
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/metadata/item":
+			_, _ = io.WriteString(w, `{"files": [{"name": "item_meta.xml"}], "item_size": 1}`)
+		default:
+			// archive.org returns an empty object for missing items
+			_, _ = io.WriteString(w, `{}`)
+		}
+	}))
+	defer front.Close()
+
+	for _, test := range []struct {
+		root    string
+		want    string
+		wantErr string
+	}{
+		{"item", front.URL + "/compress/item", ""},
+		{"item/", front.URL + "/compress/item", ""},
+		{"missing", "", fs.ErrorDirNotFound.Error()},
+		{"item/dir", "", "zip can only be used on the whole item, not a directory inside it"},
+		{"", "", fs.ErrorListBucketRequired.Error()},
+	} {
+		f := newTestFs(front.URL)
+		f.root = test.root
+		// a trailing slash on the endpoint shouldn't matter
+		f.opt.FrontEndpoint = front.URL + "/"
+		out, err := f.Command(ctx, "zip", nil, nil)
+		if test.wantErr != "" {
+			assert.EqualError(t, err, test.wantErr, test.root)
+			continue
+		}
+		require.NoError(t, err, test.root)
+		assert.Equal(t, test.want, out, test.root)
+	}
+
+	f := newTestFs(front.URL)
+	_, err := f.Command(ctx, "potato", nil, nil)
+	assert.Equal(t, fs.ErrorCommandNotFound, err)
+}